@@ -2,42 +2,95 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"text/template"
 	"time"
 
 	"github.com/google/uuid"
+	"golang.org/x/sync/errgroup"
 )
 
 type Agent struct {
-	ServerAddress string
-	EnrollSecret  string
-	NodeKey       string
-	UUID          string
-	Client        http.Client
-	Templates     *template.Template
-	strings       map[string]string
-}
-
-func NewAgent(serverAddress, enrollSecret string, templates *template.Template) *Agent {
-	transport := http.DefaultTransport.(*http.Transport).Clone()
-	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	transport.DisableCompression = true
+	ServerAddress  string
+	EnrollSecret   string
+	UUID           string
+	Client         *http.Client
+	Templates      *template.Template
+	strings        map[string]string
+	stringPools    map[string][]string
+	osFamily       string
+	osqueryVersion string
+
+	ctx context.Context
+
+	nodeKeyMu sync.Mutex
+	nodeKey   string
+
+	logCfg      logConfig
+	carveSizeMB int
+	scheduleMu  sync.Mutex
+	schedule    map[string]*queryState
+}
+
+// NodeKey returns the node key the server last handed us at enroll, safe
+// for concurrent use by the poll loop, log scheduler and carve goroutines.
+func (a *Agent) NodeKey() string {
+	a.nodeKeyMu.Lock()
+	defer a.nodeKeyMu.Unlock()
+	return a.nodeKey
+}
+
+func (a *Agent) setNodeKey(key string) {
+	a.nodeKeyMu.Lock()
+	defer a.nodeKeyMu.Unlock()
+	a.nodeKey = key
+}
+
+// NewAgentFromProfile builds an Agent whose persona (OS family, osquery
+// version, cached-string pools) and templates come from profile, so a
+// single invocation can simulate a fleet of different machine kinds
+// rather than a monoculture.
+func NewAgentFromProfile(ctx context.Context, serverAddress, enrollSecret string, client *http.Client, profile *Profile, templates *template.Template, logCfg logConfig, carveSizeMB int) *Agent {
 	return &Agent{
-		ServerAddress: serverAddress,
-		EnrollSecret:  enrollSecret,
-		Templates:     templates,
-		UUID:          uuid.New().String(),
-		Client:        http.Client{Transport: transport},
-		strings:       make(map[string]string),
+		ServerAddress:  serverAddress,
+		EnrollSecret:   enrollSecret,
+		Templates:      templates,
+		UUID:           uuid.New().String(),
+		Client:         client,
+		strings:        make(map[string]string),
+		stringPools:    profile.Strings,
+		osFamily:       profile.OSFamily,
+		osqueryVersion: profile.OSQueryVersion,
+		ctx:            ctx,
+		logCfg:         logCfg,
+		carveSizeMB:    carveSizeMB,
+		schedule:       make(map[string]*queryState),
+	}
+}
+
+// userAgent returns the osquery User-Agent header value this agent's
+// profile reports, defaulting to a recent osquery release.
+func (a *Agent) userAgent() string {
+	return "osquery/" + a.osqueryVersionString()
+}
+
+func (a *Agent) osqueryVersionString() string {
+	if a.osqueryVersion == "" {
+		return "4.1.2"
 	}
+	return a.osqueryVersion
 }
 
 type enrollResponse struct {
@@ -45,20 +98,72 @@ type enrollResponse struct {
 }
 
 type distributedReadResponse struct {
-	Queries map[string]string `json:"queries"`
+	NodeInvalid bool              `json:"node_invalid"`
+	Queries     map[string]string `json:"queries"`
 }
 
+// runLoop polls the server until a.ctx is canceled. A node_invalid
+// response from /config or /distributed/read means the server no longer
+// recognizes our node key (e.g. it restarted with a fresh database), so
+// we re-enroll with backoff instead of spinning on the stale key forever.
 func (a *Agent) runLoop() {
+	activeAgents.Inc()
+	defer activeAgents.Dec()
+
 	a.Enroll()
+	go a.runLogScheduler()
 	for {
-		a.Config()
-		resp, err := a.DistributedRead()
-		if err != nil {
-			log.Println(err)
-		} else {
-			a.DistributedWrite(resp.Queries)
+		select {
+		case <-a.ctx.Done():
+			return
+		default:
+		}
+
+		invalid := a.Config()
+		if !invalid {
+			resp, err := a.DistributedRead()
+			if err != nil {
+				log.Println(err)
+			} else if resp.NodeInvalid {
+				invalid = true
+			} else {
+				a.DistributedWrite(resp.Queries)
+			}
+		}
+
+		if invalid {
+			a.reEnroll()
+		}
+
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// reEnroll re-runs Enroll until it succeeds or the agent's context is
+// canceled, backing off exponentially so a server restart under a large
+// simulated fleet doesn't turn into a re-enroll thundering herd.
+func (a *Agent) reEnroll() {
+	backoff := time.Second
+	const maxBackoff = 5 * time.Minute
+	for {
+		a.setNodeKey("")
+		a.Enroll()
+		if a.NodeKey() != "" {
+			return
+		}
+
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
 		}
-		time.Sleep(10 * time.Second)
 	}
 }
 
@@ -73,11 +178,21 @@ func (a *Agent) randomString(n int) string {
 	return sb.String()
 }
 
+// CachedString returns a stable value for key, generated once per agent.
+// If the agent's profile defines a string pool for key, the value is
+// drawn from that pool (e.g. a hostname or username list); otherwise a
+// random string is generated, as before profiles existed.
 func (a *Agent) CachedString(key string) string {
 	if val, ok := a.strings[key]; ok {
 		return val
 	}
-	val := a.randomString(12)
+
+	var val string
+	if pool := a.stringPools[key]; len(pool) > 0 {
+		val = pool[rand.Intn(len(pool))]
+	} else {
+		val = a.randomString(12)
+	}
 	a.strings[key] = val
 	return val
 }
@@ -86,14 +201,14 @@ func (a *Agent) Enroll() {
 	var body bytes.Buffer
 	a.Templates.ExecuteTemplate(&body, "enroll", a)
 
-	req, err := http.NewRequest("POST", a.ServerAddress+"/api/v1/osquery/enroll", &body)
+	req, err := http.NewRequestWithContext(a.ctx, "POST", a.ServerAddress+"/api/v1/osquery/enroll", &body)
 	if err != nil {
 		log.Println("create request:", err)
 		return
 	}
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Accept", "application/json")
-	req.Header.Add("User-Agent", "osquery/4.1.2")
+	req.Header.Add("User-Agent", a.userAgent())
 
 	resp, err := a.Client.Do(req)
 	if err != nil {
@@ -113,81 +228,156 @@ func (a *Agent) Enroll() {
 		return
 	}
 
-	a.NodeKey = parsedResp.NodeKey
+	a.setNodeKey(parsedResp.NodeKey)
 }
 
-func (a *Agent) Config() {
-	body := bytes.NewBufferString(`{"node_key": "` + a.NodeKey + `"}`)
+// Config fetches the agent's query schedule and reports whether the
+// server considered our node key invalid.
+func (a *Agent) Config() (nodeInvalid bool) {
+	body := bytes.NewBufferString(`{"node_key": "` + a.NodeKey() + `"}`)
 
-	req, err := http.NewRequest("POST", a.ServerAddress+"/api/v1/osquery/config", body)
+	req, err := http.NewRequestWithContext(a.ctx, "POST", a.ServerAddress+"/api/v1/osquery/config", body)
 	if err != nil {
 		log.Println("create config request:", err)
-		return
+		return false
 	}
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Accept", "application/json")
-	req.Header.Add("User-Agent", "osquery/4.1.2")
+	req.Header.Add("User-Agent", a.userAgent())
 
 	resp, err := a.Client.Do(req)
 	if err != nil {
 		log.Println("do config request:", err)
-		return
+		return false
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		log.Println("config status:", resp.Status)
-		return
+		return false
 	}
 
-	// No need to read the config body
+	var parsedResp configResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsedResp); err != nil {
+		log.Println("json parse config response:", err)
+		return false
+	}
+
+	if parsedResp.NodeInvalid {
+		return true
+	}
+
+	a.updateSchedule(parsedResp.Schedule)
+	return false
+}
+
+// updateSchedule reconciles the agent's running log schedule with the
+// schedule from a fresh /config response: new queries are added, queries
+// no longer present are dropped, and queries still present take the new
+// definition but keep their lastFired/counter state rather than resetting it.
+func (a *Agent) updateSchedule(schedule map[string]scheduledQuery) {
+	a.scheduleMu.Lock()
+	defer a.scheduleMu.Unlock()
+
+	for name, query := range schedule {
+		if state, ok := a.schedule[name]; ok {
+			state.query = query
+			continue
+		}
+		a.schedule[name] = &queryState{query: query}
+	}
+	for name := range a.schedule {
+		if _, ok := schedule[name]; !ok {
+			delete(a.schedule, name)
+		}
+	}
 }
 
 func (a *Agent) DistributedRead() (*distributedReadResponse, error) {
-	body := bytes.NewBufferString(`{"node_key": "` + a.NodeKey + `"}`)
+	body := bytes.NewBufferString(`{"node_key": "` + a.NodeKey() + `"}`)
 
-	req, err := http.NewRequest("POST", a.ServerAddress+"/api/v1/osquery/distributed/read", body)
+	req, err := http.NewRequestWithContext(a.ctx, "POST", a.ServerAddress+"/api/v1/osquery/distributed/read", body)
 	if err != nil {
-		return nil, fmt.Errorf("create distributed read request:", err)
+		return nil, fmt.Errorf("create distributed read request: %w", err)
 	}
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Accept", "application/json")
-	req.Header.Add("User-Agent", "osquery/4.1.2")
+	req.Header.Add("User-Agent", a.userAgent())
 
 	resp, err := a.Client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("do distributed read request:", err)
+		return nil, fmt.Errorf("do distributed read request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("distributed read status:", resp.Status)
+		return nil, fmt.Errorf("distributed read status: %s", resp.Status)
 	}
 
 	var parsedResp distributedReadResponse
 	if err := json.NewDecoder(resp.Body).Decode(&parsedResp); err != nil {
-		return nil, fmt.Errorf("json parse distributed read response:", err)
+		return nil, fmt.Errorf("json parse distributed read response: %w", err)
 	}
 
 	return &parsedResp, nil
 }
 
+type distributedWriteRequest struct {
+	NodeKey  string                `json:"node_key"`
+	Queries  map[string][]queryRow `json:"queries"`
+	Statuses map[string]int        `json:"statuses"`
+}
+
 func (a *Agent) DistributedWrite(queries map[string]string) {
-	var body bytes.Buffer
-	// Currently only responding to the set of detail/label queries
-	if _, ok := queries["kolide_detail_query_network_interface"]; !ok {
+	if len(queries) == 0 {
 		return
 	}
 
-	a.Templates.ExecuteTemplate(&body, "distributed_write", a)
-	req, err := http.NewRequest("POST", a.ServerAddress+"/api/v1/osquery/distributed/write", &body)
+	results := make(map[string][]queryRow, len(queries))
+	statuses := make(map[string]int, len(queries))
+	for name := range queries {
+		if strings.HasPrefix(name, "carve(") {
+			// A carve query kicks off the separate, bandwidth-heavy
+			// carve/begin+carve/block protocol in the background; the
+			// distributed/write response just reports the carve's GUID,
+			// as real osqueryd does.
+			carveID := uuid.New().String()
+			results[name] = []queryRow{{"carve_guid": carveID}}
+			statuses[name] = 0
+			go a.performCarve(carveID)
+			continue
+		}
+
+		gen, ok := queryGenerators[name]
+		if !ok {
+			// Unknown query: respond as if it matched no rows, same as a
+			// real osquery install running against a table it doesn't have.
+			results[name] = []queryRow{}
+			statuses[name] = 0
+			continue
+		}
+		results[name] = gen(a, a.rngForQuery(name))
+		statuses[name] = 0
+	}
+
+	payload, err := json.Marshal(distributedWriteRequest{
+		NodeKey:  a.NodeKey(),
+		Queries:  results,
+		Statuses: statuses,
+	})
+	if err != nil {
+		log.Println("marshal distributed write body:", err)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(a.ctx, "POST", a.ServerAddress+"/api/v1/osquery/distributed/write", bytes.NewReader(payload))
 	if err != nil {
 		log.Println("create distributed write request:", err)
 		return
 	}
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Accept", "application/json")
-	req.Header.Add("User-Agent", "osquery/4.1.2")
+	req.Header.Add("User-Agent", a.userAgent())
 
 	resp, err := a.Client.Do(req)
 	if err != nil {
@@ -209,26 +399,80 @@ func main() {
 	enrollSecret := flag.String("enroll_secret", "", "Enroll secret to authenticate enrollment")
 	hostCount := flag.Int("host_count", 10, "Number of hosts to start (default 10)")
 	randSeed := flag.Int64("seed", time.Now().UnixNano(), "Seed for random generator (default current time)")
+	profilesFile := flag.String("profiles", "", "Path to a YAML or JSON file of agent profiles (os family, osquery version, template dir, string pools, weight). Defaults to one profile each for darwin, linux and windows, using *.tmpl in the working directory")
+	logInterval := flag.Duration("log_interval", 10*time.Second, "How often each agent flushes scheduled query results and status logs to the server")
+	resultsPerQuery := flag.Int("results_per_query", 1, "Number of synthetic rows logged per scheduled query firing")
+	statusLogRate := flag.Float64("status_log_rate", 0.1, "Average number of status log lines logged per agent per log_interval tick")
+	enableCompression := flag.Bool("enable_compression", false, "Request gzip-compressed responses from the server (request bodies are sent uncompressed)")
+	rateLimit := flag.Float64("rate_limit", 0, "Maximum requests per second across all agents (0 disables rate limiting)")
+	metricsAddr := flag.String("metrics_addr", ":2112", "Address to serve Prometheus metrics on (empty disables the metrics server)")
+	carveSizeMB := flag.Int("carve_size_mb", 10, "Total size, in MB, of the synthetic file carved in response to a carve(...) distributed query")
 
 	flag.Parse()
 
 	rand.Seed(*randSeed)
 
-	tmpl, err := template.ParseGlob("*.tmpl")
+	var profiles []*Profile
+	if *profilesFile != "" {
+		var err error
+		profiles, err = loadProfiles(*profilesFile)
+		if err != nil {
+			log.Fatal("load profiles: ", err)
+		}
+	} else {
+		profiles = defaultProfiles()
+	}
+
+	logCfg := logConfig{
+		interval:        *logInterval,
+		resultsPerQuery: *resultsPerQuery,
+		statusLogRate:   *statusLogRate,
+	}
+
+	defaultTmpl, err := template.ParseGlob("*.tmpl")
 	if err != nil {
 		log.Fatal("parse templates: ", err)
 	}
+	templatesByProfile := make(map[*Profile]*template.Template, len(profiles))
+	for _, p := range profiles {
+		if p.TemplateDir == "" {
+			templatesByProfile[p] = defaultTmpl
+			continue
+		}
+		t, err := template.ParseGlob(filepath.Join(p.TemplateDir, "*.tmpl"))
+		if err != nil {
+			log.Fatalf("parse templates for profile %q: %v", p.Name, err)
+		}
+		templatesByProfile[p] = t
+	}
+
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+
+	client := newSharedClient(*enableCompression, *rateLimit)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	g, ctx := errgroup.WithContext(ctx)
 
 	// Spread requests over the 10 seconds interval
 	sleepTime := (10 * time.Second) / time.Duration(*hostCount)
 	var agents []*Agent
 	for i := 0; i < *hostCount; i++ {
-		a := NewAgent(*serverURL, *enrollSecret, tmpl)
+		profile := pickProfile(profiles)
+		a := NewAgentFromProfile(ctx, *serverURL, *enrollSecret, client, profile, templatesByProfile[profile], logCfg, *carveSizeMB)
 		agents = append(agents, a)
-		go a.runLoop()
+		g.Go(func() error {
+			a.runLoop()
+			return nil
+		})
 		time.Sleep(sleepTime)
 	}
 
-	fmt.Println("Agents running. Kill with C-c.")
-	<-make(chan struct{})
+	fmt.Println("Agents running. Ctrl-C to stop.")
+	if err := g.Wait(); err != nil {
+		log.Println("agent group:", err)
+	}
 }
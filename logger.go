@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// scheduledQuery is one entry of the "schedule" map in an osquery /config
+// response: a named query osqueryd runs on a recurring interval and logs
+// the results of, either as a differential ("added"/"removed") log per
+// row or, if Snapshot is set, a single snapshot log of all rows.
+type scheduledQuery struct {
+	Query    string `json:"query"`
+	Interval int    `json:"interval"`
+	Snapshot bool   `json:"snapshot,omitempty"`
+}
+
+type configResponse struct {
+	NodeInvalid bool                      `json:"node_invalid"`
+	Schedule    map[string]scheduledQuery `json:"schedule"`
+}
+
+// queryState tracks when a scheduled query last fired so the log
+// scheduler can honor each query's own interval independently.
+type queryState struct {
+	query     scheduledQuery
+	lastFired time.Time
+	counter   int
+}
+
+// logConfig bundles the operator-facing knobs that control how heavily a
+// simulated agent exercises the server's log-ingestion pipeline.
+type logConfig struct {
+	interval        time.Duration
+	resultsPerQuery int
+	statusLogRate   float64 // average status log lines produced per logConfig.interval tick
+}
+
+type logRequest struct {
+	NodeKey string            `json:"node_key"`
+	LogType string            `json:"log_type"`
+	Data    []json.RawMessage `json:"data"`
+}
+
+// runLogScheduler fires on a.logCfg.interval, and at each tick logs the
+// result of every scheduled query whose own interval has elapsed, plus a
+// batch of synthetic status log lines, to the osquery logger endpoint.
+func (a *Agent) runLogScheduler() {
+	if a.logCfg.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(a.logCfg.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-ticker.C:
+			a.flushLogs()
+		}
+	}
+}
+
+func (a *Agent) flushLogs() {
+	resultLogs := a.dueResultLogs()
+	if len(resultLogs) > 0 {
+		a.postLogs("result", resultLogs)
+	}
+
+	statusLogs := a.statusLogs()
+	if len(statusLogs) > 0 {
+		a.postLogs("status", statusLogs)
+	}
+}
+
+func (a *Agent) dueResultLogs() []json.RawMessage {
+	now := time.Now()
+
+	a.scheduleMu.Lock()
+	defer a.scheduleMu.Unlock()
+
+	var logs []json.RawMessage
+	for name, state := range a.schedule {
+		if !state.lastFired.IsZero() && now.Sub(state.lastFired) < time.Duration(state.query.Interval)*time.Second {
+			continue
+		}
+		state.lastFired = now
+		state.counter++
+
+		rng := a.rngForQuery(name + strconv.Itoa(state.counter))
+		rows := genScheduledResult(name, a.logCfg.resultsPerQuery, rng)
+		logs = append(logs, resultLogEntries(a, name, state.query.Snapshot, state.counter, rows, rng)...)
+	}
+	return logs
+}
+
+// removedRowRate is the fraction of rows in a differential log that are
+// reported as "removed" rather than "added", standing in for the rows
+// real differential logging drops between one scheduled run and the next.
+const removedRowRate = 0.1
+
+func resultLogEntries(a *Agent, name string, snapshot bool, counter int, rows []queryRow, rng *rand.Rand) []json.RawMessage {
+	now := time.Now()
+	if snapshot {
+		entry, err := json.Marshal(struct {
+			Name           string     `json:"name"`
+			HostIdentifier string     `json:"hostIdentifier"`
+			CalendarTime   string     `json:"calendarTime"`
+			UnixTime       int64      `json:"unixTime"`
+			Snapshot       []queryRow `json:"snapshot"`
+			Action         string     `json:"action"`
+		}{name, a.UUID, now.UTC().Format(time.RFC1123), now.Unix(), rows, "snapshot"})
+		if err != nil {
+			log.Println("marshal snapshot log:", err)
+			return nil
+		}
+		return []json.RawMessage{entry}
+	}
+
+	entries := make([]json.RawMessage, 0, len(rows))
+	for _, row := range rows {
+		action := "added"
+		if counter > 1 && rng.Float64() < removedRowRate {
+			action = "removed"
+		}
+		entry, err := json.Marshal(struct {
+			Name           string   `json:"name"`
+			HostIdentifier string   `json:"hostIdentifier"`
+			CalendarTime   string   `json:"calendarTime"`
+			UnixTime       int64    `json:"unixTime"`
+			Epoch          int      `json:"epoch"`
+			Counter        int      `json:"counter"`
+			Columns        queryRow `json:"columns"`
+			Action         string   `json:"action"`
+		}{name, a.UUID, now.UTC().Format(time.RFC1123), now.Unix(), 0, counter, row, action})
+		if err != nil {
+			log.Println("marshal differential log:", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func genScheduledResult(name string, n int, rng *rand.Rand) []queryRow {
+	if n <= 0 {
+		n = 1
+	}
+	rows := make([]queryRow, 0, n)
+	for i := 0; i < n; i++ {
+		rows = append(rows, queryRow{
+			"query_name": name,
+			"value":      fmt.Sprintf("%d", rng.Intn(1000)),
+		})
+	}
+	return rows
+}
+
+// statusLogs fabricates a batch of osqueryd internal status log lines,
+// the chatter a real agent produces regardless of its schedule.
+func (a *Agent) statusLogs() []json.RawMessage {
+	rate := a.logCfg.statusLogRate
+	if rate <= 0 {
+		return nil
+	}
+	n := int(rate)
+	if rand.Float64() < rate-float64(n) {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	logs := make([]json.RawMessage, 0, n)
+	for i := 0; i < n; i++ {
+		entry, err := json.Marshal(struct {
+			Severity       int    `json:"severity"`
+			Filename       string `json:"filename"`
+			Line           string `json:"line"`
+			Message        string `json:"message"`
+			Version        string `json:"version"`
+			HostIdentifier string `json:"hostIdentifier"`
+			CalendarTime   string `json:"calendarTime"`
+			UnixTime       int64  `json:"unixTime"`
+		}{0, "scheduler.cpp", "554", "Executing scheduled query", a.osqueryVersionString(), a.UUID, now.UTC().Format(time.RFC1123), now.Unix()})
+		if err != nil {
+			log.Println("marshal status log:", err)
+			continue
+		}
+		logs = append(logs, entry)
+	}
+	return logs
+}
+
+func (a *Agent) postLogs(logType string, data []json.RawMessage) {
+	payload, err := json.Marshal(logRequest{
+		NodeKey: a.NodeKey(),
+		LogType: logType,
+		Data:    data,
+	})
+	if err != nil {
+		log.Println("marshal log request:", err)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(a.ctx, "POST", a.ServerAddress+"/api/v1/osquery/log", bytes.NewReader(payload))
+	if err != nil {
+		log.Println("create log request:", err)
+		return
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("User-Agent", a.userAgent())
+
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		log.Println("do log request:", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Println("log status:", resp.Status)
+	}
+}
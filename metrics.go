@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "osquery_perf_requests_total",
+		Help: "Total HTTP requests made to the osquery server, by endpoint and status code.",
+	}, []string{"endpoint", "status"})
+
+	requestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "osquery_perf_request_errors_total",
+		Help: "Total HTTP requests that failed before a response was received, by endpoint.",
+	}, []string{"endpoint"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "osquery_perf_request_duration_seconds",
+		Help:    "Latency of HTTP requests to the osquery server, by endpoint.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	activeAgents = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "osquery_perf_active_agents",
+		Help: "Number of simulated agents currently running their poll loop.",
+	})
+)
+
+// endpointLabel collapses a request path into a low-cardinality metric
+// label; carve begin and block requests share the single "carve" label,
+// and any path not listed here is labeled "other".
+func endpointLabel(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/api/v1/osquery/enroll"):
+		return "enroll"
+	case strings.HasPrefix(path, "/api/v1/osquery/config"):
+		return "config"
+	case strings.HasPrefix(path, "/api/v1/osquery/distributed/read"):
+		return "distributed_read"
+	case strings.HasPrefix(path, "/api/v1/osquery/distributed/write"):
+		return "distributed_write"
+	case strings.HasPrefix(path, "/api/v1/osquery/log"):
+		return "log"
+	case strings.HasPrefix(path, "/api/v1/osquery/carve"):
+		return "carve"
+	default:
+		return "other"
+	}
+}
+
+// serveMetrics exposes a Prometheus /metrics endpoint on addr. Meant to
+// be run in its own goroutine for the lifetime of the process.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Println("metrics server:", err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+// osVersionInfo is one entry from a persona's pool of plausible OS
+// versions for kolide_detail_query_os_version.
+type osVersionInfo struct {
+	name, version, major, minor, patch, build string
+}
+
+// appInfo is one entry from a persona's pool of installed applications.
+type appInfo struct {
+	name, version string
+}
+
+// persona describes the pools of realistic values used to generate query
+// results for one OS family, so that a simulated fleet looks like a mix
+// of real machines rather than thousands of identical hosts.
+type persona struct {
+	platform        string
+	osVersions      []osVersionInfo
+	hardwareVendors []string
+	hardwareModels  []string
+	cpuBrands       []string
+	memorySizes     []string
+	usernames       []string
+	shells          []string
+	apps            []appInfo
+	appSource       string
+	processes       []string
+	interfaces      []string
+}
+
+func (p persona) homeDir(user string) string {
+	switch p.platform {
+	case "darwin":
+		return "/Users/" + user
+	case "windows":
+		return `C:\Users\` + user
+	default:
+		return "/home/" + user
+	}
+}
+
+func (p persona) processPath(name string) string {
+	switch p.platform {
+	case "windows":
+		return `C:\Program Files\` + name + `\` + name + ".exe"
+	case "darwin":
+		return "/usr/sbin/" + name
+	default:
+		return "/usr/bin/" + name
+	}
+}
+
+var macOSPersona = persona{
+	platform: "darwin",
+	osVersions: []osVersionInfo{
+		{name: "macOS", version: "13.6.1", major: "13", minor: "6", patch: "1", build: "22G313"},
+		{name: "macOS", version: "14.1", major: "14", minor: "1", patch: "0", build: "23B74"},
+		{name: "macOS", version: "12.7.1", major: "12", minor: "7", patch: "1", build: "21G920"},
+	},
+	hardwareVendors: []string{"Apple Inc."},
+	hardwareModels:  []string{"MacBookPro18,3", "MacBookPro18,4", "MacBookAir10,1", "Mac14,9"},
+	cpuBrands:       []string{"Apple M1 Pro", "Apple M2", "Apple M1"},
+	memorySizes:     []string{"17179869184", "34359738368", "8589934592"},
+	usernames:       []string{"jsmith", "agarcia", "mchen", "klee", "rsingh"},
+	shells:          []string{"/bin/zsh", "/bin/bash"},
+	appSource:       "apps",
+	apps: []appInfo{
+		{"Slack", "4.35.126"}, {"Google Chrome", "119.0.6045.123"}, {"zoom.us", "5.16.10"},
+		{"Visual Studio Code", "1.84.2"}, {"1Password 7", "7.9.8"}, {"Docker", "4.25.2"},
+		{"Microsoft Excel", "16.78"}, {"Figma", "116.16.4"},
+	},
+	processes:  []string{"launchd", "WindowServer", "Finder", "Dock", "cfprefsd", "corespeechd", "zoom.us"},
+	interfaces: []string{"en0", "en1", "awdl0"},
+}
+
+var linuxPersona = persona{
+	platform: "linux",
+	osVersions: []osVersionInfo{
+		{name: "Ubuntu", version: "22.04.3 LTS", major: "22", minor: "4", patch: "0", build: ""},
+		{name: "Ubuntu", version: "20.04.6 LTS", major: "20", minor: "4", patch: "6", build: ""},
+		{name: "Amazon Linux", version: "2023", major: "2023", minor: "0", patch: "0", build: ""},
+		{name: "Debian GNU/Linux", version: "12", major: "12", minor: "0", patch: "0", build: ""},
+	},
+	hardwareVendors: []string{"Dell Inc.", "Amazon EC2", "QEMU"},
+	hardwareModels:  []string{"PowerEdge R650", "c5.xlarge", "Standard PC (Q35 + ICH9, 2009)"},
+	cpuBrands:       []string{"Intel(R) Xeon(R) Platinum 8259CL", "AMD EPYC 7R32", "Intel(R) Xeon(R) CPU E5-2686 v4"},
+	memorySizes:     []string{"16777216000", "33554432000", "67108864000"},
+	usernames:       []string{"root", "ubuntu", "deploy", "jenkins", "svc-monitoring"},
+	shells:          []string{"/bin/bash", "/usr/bin/zsh", "/bin/sh"},
+	appSource:       "deb_packages",
+	apps: []appInfo{
+		{"openssh-server", "1:8.9p1-3"}, {"nginx", "1.18.0-6ubuntu14"}, {"docker-ce", "5:24.0.7"},
+		{"python3", "3.10.6-1"}, {"postgresql-14", "14.9-0ubuntu0.22.04.1"}, {"libc6", "2.35-0ubuntu3.6"},
+	},
+	processes:  []string{"sshd", "systemd", "nginx", "dockerd", "containerd", "cron", "rsyslogd"},
+	interfaces: []string{"eth0", "ens5", "enp0s3"},
+}
+
+var windowsPersona = persona{
+	platform: "windows",
+	osVersions: []osVersionInfo{
+		{name: "Windows 10 Enterprise", version: "10.0.19045", major: "10", minor: "0", patch: "19045", build: "19045"},
+		{name: "Windows 11 Enterprise", version: "10.0.22631", major: "10", minor: "0", patch: "22631", build: "22631"},
+	},
+	hardwareVendors: []string{"Dell Inc.", "HP", "Lenovo"},
+	hardwareModels:  []string{"Latitude 5420", "EliteBook 840 G8", "ThinkPad T14"},
+	cpuBrands:       []string{"Intel(R) Core(TM) i7-1185G7", "Intel(R) Core(TM) i5-1135G7"},
+	memorySizes:     []string{"17179869184", "8589934592"},
+	usernames:       []string{"jdoe", "asmith", "corp\\tjones", "corp\\lwong"},
+	shells:          []string{`C:\Windows\System32\cmd.exe`},
+	appSource:       "programs",
+	apps: []appInfo{
+		{"Microsoft Office 365", "16.0.16827"}, {"Google Chrome", "119.0.6045.160"},
+		{"CrowdStrike Windows Sensor", "7.11.17207"}, {"Zoom", "5.16.10"}, {"7-Zip", "23.01"},
+	},
+	processes:  []string{"explorer.exe", "svchost.exe", "csrss.exe", "CSFalconService.exe", "winlogon.exe"},
+	interfaces: []string{"Ethernet", "Ethernet 2", "Wi-Fi"},
+}
+
+var personasByFamily = map[string]persona{
+	"darwin":  macOSPersona,
+	"linux":   linuxPersona,
+	"windows": windowsPersona,
+}
+
+// persona returns the value pools this agent should draw from when
+// generating query results.
+func (a *Agent) persona() persona {
+	p, ok := personasByFamily[a.osFamily]
+	if !ok {
+		return linuxPersona
+	}
+	return p
+}
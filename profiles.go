@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Profile describes one simulated agent persona: which OS family and
+// osquery version it reports, which template set it renders enroll and
+// carve_block bodies from, a pool of strings (hostnames, usernames,
+// hardware serials, ...) its cached values are drawn from, and how often
+// it should be picked relative to the other loaded profiles.
+type Profile struct {
+	Name           string              `json:"name" yaml:"name"`
+	OSFamily       string              `json:"os_family" yaml:"os_family"`
+	OSQueryVersion string              `json:"osquery_version" yaml:"osquery_version"`
+	TemplateDir    string              `json:"template_dir" yaml:"template_dir"`
+	Strings        map[string][]string `json:"strings" yaml:"strings"`
+	Weight         int                 `json:"weight" yaml:"weight"`
+}
+
+// defaultProfiles is used when --profiles is not set: a single profile
+// per built-in OS family, weighted like a typical corporate fleet, using
+// the template set in the working directory.
+func defaultProfiles() []*Profile {
+	return []*Profile{
+		{Name: "default-darwin", OSFamily: "darwin", Weight: 70},
+		{Name: "default-linux", OSFamily: "linux", Weight: 20},
+		{Name: "default-windows", OSFamily: "windows", Weight: 10},
+	}
+}
+
+// loadProfiles reads a YAML or JSON file of profiles, keyed by its file
+// extension.
+func loadProfiles(path string) ([]*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read profiles file: %w", err)
+	}
+
+	var profiles []*Profile
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &profiles); err != nil {
+			return nil, fmt.Errorf("parse profiles yaml: %w", err)
+		}
+	case ".json":
+		if err := json.Unmarshal(data, &profiles); err != nil {
+			return nil, fmt.Errorf("parse profiles json: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported profiles file extension %q, want .yaml, .yml or .json", ext)
+	}
+
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("profiles file %q defines no profiles", path)
+	}
+	for _, p := range profiles {
+		if _, ok := personasByFamily[p.OSFamily]; !ok {
+			return nil, fmt.Errorf("profile %q: unknown os_family %q", p.Name, p.OSFamily)
+		}
+		if p.Weight <= 0 {
+			p.Weight = 1
+		}
+	}
+	return profiles, nil
+}
+
+// pickProfile randomly selects a profile, weighted by each profile's
+// share of the total weight across all loaded profiles.
+func pickProfile(profiles []*Profile) *Profile {
+	total := 0
+	for _, p := range profiles {
+		total += p.Weight
+	}
+
+	n := rand.Intn(total)
+	for _, p := range profiles {
+		if n < p.Weight {
+			return p
+		}
+		n -= p.Weight
+	}
+	return profiles[len(profiles)-1]
+}
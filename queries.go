@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+)
+
+// queryRow is a single osquery result row, shaped for direct JSON
+// marshaling (osquery returns all column values as strings).
+type queryRow map[string]string
+
+// queryGenerator produces the rows a given detail/label query would return
+// for an agent, using rng for any randomized fields so that results are
+// reproducible for a given agent/query pair.
+type queryGenerator func(a *Agent, rng *rand.Rand) []queryRow
+
+// queryGenerators maps the detail/label query names Fleet/Kolide servers
+// send in a distributed/read response to the generator that fabricates a
+// plausible result set for them. Queries with no registered generator are
+// answered with zero rows, matching how osquery reports a query that
+// matched no rows on the host.
+var queryGenerators = map[string]queryGenerator{
+	"kolide_detail_query_network_interface": genNetworkInterface,
+	"kolide_detail_query_os_version":        genOSVersion,
+	"kolide_detail_query_system_info":       genSystemInfo,
+	"kolide_detail_query_users":             genUsers,
+	"kolide_detail_query_software_macos":    genInstalledApps,
+	"kolide_label_query_listening_ports":    genListeningPorts,
+	"kolide_label_query_processes":          genProcesses,
+}
+
+// rngForQuery returns a random source seeded deterministically from the
+// agent's UUID and the query name, so repeated calls for the same
+// agent/query pair always produce the same rows.
+func (a *Agent) rngForQuery(query string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(a.UUID))
+	h.Write([]byte(query))
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+func genNetworkInterface(a *Agent, rng *rand.Rand) []queryRow {
+	p := a.persona()
+	return []queryRow{{
+		"interface": p.interfaces[rng.Intn(len(p.interfaces))],
+		"mac":       randomMAC(rng),
+		"address":   randomPrivateIP(rng),
+	}}
+}
+
+func genOSVersion(a *Agent, rng *rand.Rand) []queryRow {
+	p := a.persona()
+	v := p.osVersions[rng.Intn(len(p.osVersions))]
+	return []queryRow{{
+		"name":     v.name,
+		"version":  v.version,
+		"major":    v.major,
+		"minor":    v.minor,
+		"patch":    v.patch,
+		"build":    v.build,
+		"platform": p.platform,
+		"arch":     "x86_64",
+	}}
+}
+
+func genSystemInfo(a *Agent, rng *rand.Rand) []queryRow {
+	p := a.persona()
+	return []queryRow{{
+		"hostname":        a.CachedString("hostname"),
+		"uuid":            a.UUID,
+		"hardware_vendor": p.hardwareVendors[rng.Intn(len(p.hardwareVendors))],
+		"hardware_model":  p.hardwareModels[rng.Intn(len(p.hardwareModels))],
+		"hardware_serial": randomSerial(rng),
+		"cpu_brand":       p.cpuBrands[rng.Intn(len(p.cpuBrands))],
+		"physical_memory": p.memorySizes[rng.Intn(len(p.memorySizes))],
+	}}
+}
+
+func genUsers(a *Agent, rng *rand.Rand) []queryRow {
+	p := a.persona()
+	n := 1 + rng.Intn(3)
+	rows := make([]queryRow, 0, n)
+	for i := 0; i < n; i++ {
+		rows = append(rows, queryRow{
+			"uid":       randomUID(rng),
+			"username":  p.usernames[rng.Intn(len(p.usernames))],
+			"directory": p.homeDir(p.usernames[rng.Intn(len(p.usernames))]),
+			"shell":     p.shells[rng.Intn(len(p.shells))],
+		})
+	}
+	return rows
+}
+
+func genInstalledApps(a *Agent, rng *rand.Rand) []queryRow {
+	p := a.persona()
+	n := 5 + rng.Intn(15)
+	rows := make([]queryRow, 0, n)
+	for i := 0; i < n; i++ {
+		app := p.apps[rng.Intn(len(p.apps))]
+		rows = append(rows, queryRow{
+			"name":    app.name,
+			"version": app.version,
+			"source":  p.appSource,
+		})
+	}
+	return rows
+}
+
+func genListeningPorts(a *Agent, rng *rand.Rand) []queryRow {
+	p := a.persona()
+	n := 2 + rng.Intn(6)
+	rows := make([]queryRow, 0, n)
+	for i := 0; i < n; i++ {
+		rows = append(rows, queryRow{
+			"pid":      randomPID(rng),
+			"port":     randomPort(rng),
+			"protocol": "6",
+			"address":  "0.0.0.0",
+			"path":     p.processes[rng.Intn(len(p.processes))],
+		})
+	}
+	return rows
+}
+
+func genProcesses(a *Agent, rng *rand.Rand) []queryRow {
+	p := a.persona()
+	n := 10 + rng.Intn(40)
+	rows := make([]queryRow, 0, n)
+	for i := 0; i < n; i++ {
+		rows = append(rows, queryRow{
+			"pid":  randomPID(rng),
+			"name": p.processes[rng.Intn(len(p.processes))],
+			"path": p.processPath(p.processes[rng.Intn(len(p.processes))]),
+		})
+	}
+	return rows
+}
+
+func randomMAC(rng *rand.Rand) string {
+	b := make([]byte, 6)
+	rng.Read(b)
+	b[0] = (b[0] | 0x02) & 0xfe // locally administered, unicast
+	return formatMAC(b)
+}
+
+func formatMAC(b []byte) string {
+	const hex = "0123456789abcdef"
+	out := make([]byte, 0, 17)
+	for i, c := range b {
+		if i > 0 {
+			out = append(out, ':')
+		}
+		out = append(out, hex[c>>4], hex[c&0xf])
+	}
+	return string(out)
+}
+
+func randomPrivateIP(rng *rand.Rand) string {
+	return fmt.Sprintf("10.%d.%d.%d", rng.Intn(256), rng.Intn(256), 1+rng.Intn(254))
+}
+
+func randomSerial(rng *rand.Rand) string {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	out := make([]byte, 12)
+	for i := range out {
+		out[i] = alphabet[rng.Intn(len(alphabet))]
+	}
+	return string(out)
+}
+
+func randomUID(rng *rand.Rand) string {
+	return strconv.Itoa(501 + rng.Intn(500))
+}
+
+func randomPID(rng *rand.Rand) string {
+	return strconv.Itoa(1 + rng.Intn(65535))
+}
+
+func randomPort(rng *rand.Rand) string {
+	return strconv.Itoa(1024 + rng.Intn(64511))
+}